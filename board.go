@@ -0,0 +1,238 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pi
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Capability is a bitmask of the functions a pin can be switched into.
+type Capability uint16
+
+const (
+	// CapInput marks a pin that can be configured as a digital input.
+	CapInput Capability = 1 << iota
+	// CapOutput marks a pin that can be configured as a digital output.
+	CapOutput
+	// CapPWM marks a pin that can be driven by the hardware PWM peripheral.
+	CapPWM
+	// CapI2C marks a pin that can be switched to an I2C (SDA/SCL) alternate function.
+	CapI2C
+	// CapSPI marks a pin that can be switched to an SPI alternate function.
+	CapSPI
+	// CapUART marks a pin that can be switched to a UART (TX/RX) alternate function.
+	CapUART
+)
+
+// PinDesc describes a single physical GPIO pin: its BCM number, the names it
+// can be looked up by, and the functions it can be switched into.
+type PinDesc struct {
+	// Number is the BCM GPIO number.
+	Number uint8
+	// Names are the names this pin can be looked up by (e.g. "GPIO23", "P1_16", "SDA1").
+	Names []string
+	// Capabilities is the mask of functions this pin supports.
+	Capabilities Capability
+}
+
+// PinMap is the set of pin descriptors exposed by a Board.
+type PinMap []PinDesc
+
+// Lookup finds the PinDesc whose Names contains name.
+func (pm PinMap) Lookup(name string) (*PinDesc, bool) {
+	for i := range pm {
+		for _, n := range pm[i].Names {
+			if n == name {
+				return &pm[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// ByNumber finds the PinDesc for the given BCM GPIO number.
+func (pm PinMap) ByNumber(number uint8) (*PinDesc, bool) {
+	for i := range pm {
+		if pm[i].Number == number {
+			return &pm[i], true
+		}
+	}
+	return nil, false
+}
+
+// Board abstracts the differences between the BCM SoCs used across Raspberry
+// Pi models: the base address of the peripheral register space and the set
+// of pins available on the 40 (or 26) pin header.
+type Board interface {
+	// Name is the human-readable board/SoC name (e.g. "BCM2837 (Pi 3)").
+	Name() string
+	// BaseAddress is the physical base address of the peripheral register space.
+	BaseAddress() int64
+	// PinMap is the set of pins exposed by this board.
+	PinMap() PinMap
+}
+
+// headerPinMap is the 40-pin header layout shared by the BCM2835, BCM2836,
+// BCM2837 and BCM2711 boards; only the peripheral base address differs
+// between them.
+func headerPinMap() PinMap {
+	return PinMap{
+		{Number: 2, Names: []string{"GPIO2", "P1_03", "SDA1"}, Capabilities: CapInput | CapOutput | CapI2C},
+		{Number: 3, Names: []string{"GPIO3", "P1_05", "SCL1"}, Capabilities: CapInput | CapOutput | CapI2C},
+		{Number: 4, Names: []string{"GPIO4", "P1_07"}, Capabilities: CapInput | CapOutput},
+		{Number: 5, Names: []string{"GPIO5", "P1_29"}, Capabilities: CapInput | CapOutput},
+		{Number: 6, Names: []string{"GPIO6", "P1_31"}, Capabilities: CapInput | CapOutput},
+		{Number: 7, Names: []string{"GPIO7", "P1_26", "SPI0_CE1"}, Capabilities: CapInput | CapOutput | CapSPI},
+		{Number: 8, Names: []string{"GPIO8", "P1_24", "SPI0_CE0"}, Capabilities: CapInput | CapOutput | CapSPI},
+		{Number: 9, Names: []string{"GPIO9", "P1_21", "SPI0_MISO"}, Capabilities: CapInput | CapOutput | CapSPI},
+		{Number: 10, Names: []string{"GPIO10", "P1_19", "SPI0_MOSI"}, Capabilities: CapInput | CapOutput | CapSPI},
+		{Number: 11, Names: []string{"GPIO11", "P1_23", "SPI0_SCLK"}, Capabilities: CapInput | CapOutput | CapSPI},
+		{Number: 12, Names: []string{"GPIO12", "P1_32", "PWM0"}, Capabilities: CapInput | CapOutput | CapPWM},
+		{Number: 13, Names: []string{"GPIO13", "P1_33", "PWM1"}, Capabilities: CapInput | CapOutput | CapPWM},
+		{Number: 14, Names: []string{"GPIO14", "P1_08", "TXD0"}, Capabilities: CapInput | CapOutput | CapUART},
+		{Number: 15, Names: []string{"GPIO15", "P1_10", "RXD0"}, Capabilities: CapInput | CapOutput | CapUART},
+		{Number: 16, Names: []string{"GPIO16", "P1_36"}, Capabilities: CapInput | CapOutput},
+		{Number: 17, Names: []string{"GPIO17", "P1_11"}, Capabilities: CapInput | CapOutput},
+		{Number: 18, Names: []string{"GPIO18", "P1_12", "PWM0"}, Capabilities: CapInput | CapOutput | CapPWM},
+		{Number: 19, Names: []string{"GPIO19", "P1_35", "PWM1"}, Capabilities: CapInput | CapOutput | CapPWM},
+		{Number: 20, Names: []string{"GPIO20", "P1_38"}, Capabilities: CapInput | CapOutput},
+		{Number: 21, Names: []string{"GPIO21", "P1_40"}, Capabilities: CapInput | CapOutput},
+		{Number: 22, Names: []string{"GPIO22", "P1_15"}, Capabilities: CapInput | CapOutput},
+		{Number: 23, Names: []string{"GPIO23", "P1_16"}, Capabilities: CapInput | CapOutput},
+		{Number: 24, Names: []string{"GPIO24", "P1_18"}, Capabilities: CapInput | CapOutput},
+		{Number: 25, Names: []string{"GPIO25", "P1_22"}, Capabilities: CapInput | CapOutput},
+		{Number: 26, Names: []string{"GPIO26", "P1_37"}, Capabilities: CapInput | CapOutput},
+		{Number: 27, Names: []string{"GPIO27", "P1_13"}, Capabilities: CapInput | CapOutput},
+	}
+}
+
+type board struct {
+	name        string
+	baseAddress int64
+	pinMap      PinMap
+}
+
+func (b *board) Name() string {
+	return b.name
+}
+
+func (b *board) BaseAddress() int64 {
+	return b.baseAddress
+}
+
+func (b *board) PinMap() PinMap {
+	return b.pinMap
+}
+
+// NewBCM2835Board returns the Board for the BCM2835 SoC (Pi 1 Model B/B+, Zero).
+func NewBCM2835Board() Board {
+	return &board{name: "BCM2835 (Pi 1/Zero)", baseAddress: 0x20000000, pinMap: headerPinMap()}
+}
+
+// NewBCM2836Board returns the Board for the BCM2836 SoC (Pi 2).
+func NewBCM2836Board() Board {
+	return &board{name: "BCM2836 (Pi 2)", baseAddress: 0x3f000000, pinMap: headerPinMap()}
+}
+
+// NewBCM2837Board returns the Board for the BCM2837 SoC (Pi 3).
+func NewBCM2837Board() Board {
+	return &board{name: "BCM2837 (Pi 3)", baseAddress: 0x3f000000, pinMap: headerPinMap()}
+}
+
+// NewBCM2711Board returns the Board for the BCM2711 SoC (Pi 4).
+func NewBCM2711Board() Board {
+	return &board{name: "BCM2711 (Pi 4)", baseAddress: 0xfe000000, pinMap: headerPinMap()}
+}
+
+// DetectBoard determines which Raspberry Pi SoC the process is running on by
+// consulting /proc/device-tree/compatible and, failing that, the Revision
+// field of /proc/cpuinfo, and returns the matching Board.
+func DetectBoard() (Board, error) {
+	if b, err := detectBoardFromCompatible("/proc/device-tree/compatible"); err == nil {
+		return b, nil
+	}
+	return detectBoardFromCPUInfo("/proc/cpuinfo")
+}
+
+func detectBoardFromCompatible(path string) (Board, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	compatible := string(data)
+	switch {
+	case strings.Contains(compatible, "bcm2711"):
+		return NewBCM2711Board(), nil
+	case strings.Contains(compatible, "bcm2837"):
+		return NewBCM2837Board(), nil
+	case strings.Contains(compatible, "bcm2836"):
+		return NewBCM2836Board(), nil
+	case strings.Contains(compatible, "bcm2835"):
+		return NewBCM2835Board(), nil
+	}
+	return nil, fmt.Errorf("pi: no known board found in %s", path)
+}
+
+func detectBoardFromCPUInfo(path string) (Board, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Revision") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		revision, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		// Bit 23 set indicates the "new-style" revision encoding, where bits
+		// 12-15 hold the processor (SoC) code: 0=BCM2835, 1=BCM2836, 2=BCM2837, 3=BCM2711.
+		if revision&(1<<23) == 0 {
+			return NewBCM2835Board(), nil
+		}
+		switch (revision >> 12) & 0xf {
+		case 0:
+			return NewBCM2835Board(), nil
+		case 1:
+			return NewBCM2836Board(), nil
+		case 2:
+			return NewBCM2837Board(), nil
+		case 3:
+			return NewBCM2711Board(), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("pi: no Revision found in %s", path)
+}
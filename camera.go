@@ -22,6 +22,7 @@ package pi
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"image"
 	_ "image/jpeg" // Import to register JPEG
@@ -79,12 +80,25 @@ type Camera interface {
 	GrabFrame() ([]byte, error)
 	// GrabImage grabs a single frame and returns it as an image.
 	GrabImage() (image.Image, string, error)
+	// StartStream requests buffers, starts streaming and returns a channel that
+	// delivers frames until ctx is cancelled or StopStream is called.
+	StartStream(ctx context.Context, config StreamConfig) (<-chan Frame, error)
+	// StopStream stops a stream started with StartStream and tears down its buffer pool.
+	StopStream() error
+	// SetControl sets the value of the control identified by id (one of the Ctrl* constants).
+	SetControl(id uint32, value int32) error
+	// GetControl returns the current value of the control identified by id.
+	GetControl(id uint32) (int32, error)
+	// SetFrameInterval sets the capture frame interval to num/den seconds.
+	SetFrameInterval(num uint32, den uint32) error
 }
 
 type camera struct {
 	fd         int
 	capability *v4l2.Capability
 	fmtDescs   []*v4l2.FmtDesc
+	stopStream context.CancelFunc
+	streamDone chan struct{}
 }
 
 // OpenCamera opens the camera device at the specified path.
@@ -117,6 +131,9 @@ func (c *camera) Close() error {
 	if c.fd == -1 {
 		return syscall.EINVAL
 	}
+	if c.stopStream != nil {
+		c.StopStream()
+	}
 	if err := unix.Close(c.fd); err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package pi
 
 import (
+	"fmt"
 	"io"
 	"syscall"
 	"unsafe"
@@ -8,13 +9,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// Bcm2708Base is the BCM 2708 base address.
-const Bcm2708Base int64 = 0x2000000
-
-// GpioOffset is the GPIO offset into the BCM2708 register space.
+// GpioOffset is the GPIO offset into the peripheral register space.
 const GpioOffset int64 = 0x20000
 
-// PageSize (4K) is page size for the BCM 2708 GPIO register space.
+// PageSize (4K) is page size for the GPIO register space.
 const PageSize int = 1 << 12
 
 // GpSet0 is the register number for GPSET0.
@@ -26,64 +24,9 @@ const GpClr0 int = 10
 // GpLev0 is the register number for GPLEV0.
 const GpLev0 int = 13
 
-// Pin is the GPIO pin type.
+// Pin is the BCM GPIO pin number type.
 type Pin uint8
 
-const (
-	// GPIO2 is GPIO pin 2.
-	GPIO2 Pin = iota + 2
-	// GPIO3 is GPIO pin 3.
-	GPIO3
-	// GPIO4 is GPIO pin 4.
-	GPIO4
-	// GPIO5 is GPIO pin 5.
-	GPIO5
-	// GPIO6 is GPIO pin 6.
-	GPIO6
-	// GPIO7 is GPIO pin 7.
-	GPIO7
-	// GPIO8 is GPIO pin 8.
-	GPIO8
-	// GPIO9 is GPIO pin 9.
-	GPIO9
-	// GPIO10 is GPIO pin 10.
-	GPIO10
-	// GPIO11 is GPIO pin 11.
-	GPIO11
-	// GPIO12 is GPIO pin 12.
-	GPIO12
-	// GPIO13 is GPIO pin 13.
-	GPIO13
-	// GPIO14 is GPIO pin 14.
-	GPIO14
-	// GPIO15 is GPIO pin 15.
-	GPIO15
-	// GPIO16 is GPIO pin 16.
-	GPIO16
-	// GPIO17 is GPIO pin 17.
-	GPIO17
-	// GPIO18 is GPIO pin 18.
-	GPIO18
-	// GPIO19 is GPIO pin 19.
-	GPIO19
-	// GPIO20 is GPIO pin 20.
-	GPIO20
-	// GPIO21 is GPIO pin 21.
-	GPIO21
-	// GPIO22 is GPIO pin 22.
-	GPIO22
-	// GPIO23 is GPIO pin 23.
-	GPIO23
-	// GPIO24 is GPIO pin 24.
-	GPIO24
-	// GPIO25 is GPIO pin 25.
-	GPIO25
-	// GPIO26 is GPIO pin 26.
-	GPIO26
-	// GPIO27 is GPIO pin 27.
-	GPIO27
-)
-
 // Direction is the GPIO direction type.
 type Direction uint8
 
@@ -111,24 +54,56 @@ type GPIO interface {
 	Pin() Pin
 	Value() (Value, error)
 	SetValue(value Value) error
+	// WatchEdge watches the pin for the given Edge, delivering events on the
+	// returned channel until Close is called.
+	WatchEdge(edge Edge, opts ...WatchOption) (<-chan Event, error)
 }
 
+// GpiochipPath is the gpiochip character device backing the 40-pin header on
+// all currently supported boards.
+const GpiochipPath = "/dev/gpiochip0"
+
 type gpio struct {
 	pin       Pin
 	direction Direction
 	id        uint32
 	data      []byte
 	registers []uint32
+	chipPath  string
+	lineFd    int
+}
+
+// NewGPIO creates and returns a new GPIO instance for the pin identified by
+// name (e.g. "GPIO23", "P1_16" or "SDA1"). The board is determined via
+// DetectBoard, and the requested direction is rejected with an error if the
+// pin's capabilities don't support it.
+func NewGPIO(name string, direction Direction) (GPIO, error) {
+	b, err := DetectBoard()
+	if err != nil {
+		return nil, err
+	}
+	return newGPIO(b, name, direction)
 }
 
-// NewGPIO creates and returns a new GPIO instance
-func NewGPIO(pin Pin, direction Direction) (GPIO, error) {
+func newGPIO(b Board, name string, direction Direction) (GPIO, error) {
+	desc, ok := b.PinMap().Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("pi: %s has no pin named %q", b.Name(), name)
+	}
+	required := CapInput
+	if direction == DirectionOutput {
+		required = CapOutput
+	}
+	if desc.Capabilities&required == 0 {
+		return nil, fmt.Errorf("pi: pin %q on %s does not support direction %d", name, b.Name(), direction)
+	}
+	pin := Pin(desc.Number)
 	fd, err := unix.Open("/dev/gpiomem", unix.O_RDWR|unix.O_SYNC, 0)
 	if err != nil {
 		return nil, err
 	}
 	defer unix.Close(fd)
-	data, err := unix.Mmap(fd, Bcm2708Base+GpioOffset, PageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	data, err := unix.Mmap(fd, b.BaseAddress()+GpioOffset, PageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
 	if err != nil {
 		return nil, err
 	}
@@ -146,6 +121,8 @@ func NewGPIO(pin Pin, direction Direction) (GPIO, error) {
 		id:        id,
 		data:      data,
 		registers: registers,
+		chipPath:  GpiochipPath,
+		lineFd:    -1,
 	}, nil
 }
 
@@ -153,6 +130,10 @@ func (gpio *gpio) Close() error {
 	if gpio.data == nil {
 		return syscall.EINVAL
 	}
+	if gpio.lineFd != -1 {
+		unix.Close(gpio.lineFd)
+		gpio.lineFd = -1
+	}
 	if err := unix.Munmap(gpio.data); err != nil {
 		return err
 	}
@@ -162,7 +143,7 @@ func (gpio *gpio) Close() error {
 }
 
 func (gpio *gpio) Direction() Direction {
-	return gpio.Direction()
+	return gpio.direction
 }
 
 func (gpio *gpio) Pin() Pin {
@@ -193,3 +174,25 @@ func (gpio *gpio) SetValue(value Value) error {
 	}
 	return nil
 }
+
+func (gpio *gpio) WatchEdge(edge Edge, opts ...WatchOption) (<-chan Event, error) {
+	if gpio.data == nil {
+		return nil, syscall.EINVAL
+	}
+	options := &watchOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	events, lineFd, err := watchEdgeV2(gpio.chipPath, uint32(gpio.pin), edge, options)
+	if err != nil {
+		events, lineFd, err = watchEdgeV1(gpio.chipPath, uint32(gpio.pin), edge, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if gpio.lineFd != -1 {
+		unix.Close(gpio.lineFd)
+	}
+	gpio.lineFd = lineFd
+	return events, nil
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pi
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Edge is the GPIO edge-transition type watched by GPIO.WatchEdge.
+type Edge uint8
+
+const (
+	// EdgeRising watches for low-to-high transitions.
+	EdgeRising Edge = iota + 1
+	// EdgeFalling watches for high-to-low transitions.
+	EdgeFalling
+	// EdgeBoth watches for both transitions.
+	EdgeBoth
+)
+
+// Bias configures a watched line's internal pull resistor.
+type Bias uint8
+
+const (
+	// BiasDisabled leaves the line's bias unconfigured (the default).
+	BiasDisabled Bias = iota
+	// BiasPullUp enables the line's internal pull-up resistor.
+	BiasPullUp
+	// BiasPullDown enables the line's internal pull-down resistor.
+	BiasPullDown
+)
+
+// Event is a single edge event delivered by GPIO.WatchEdge.
+type Event struct {
+	// Edge is the transition that triggered the event.
+	Edge Edge
+	// Timestamp is the monotonic (CLOCK_MONOTONIC) time the kernel recorded the event.
+	Timestamp time.Duration
+	// Seqno is the kernel-assigned sequence number of the event. It is always
+	// zero for events read through the uAPI v1 fallback, which has no sequence number.
+	Seqno uint32
+}
+
+// WatchOption configures a GPIO.WatchEdge call.
+type WatchOption func(*watchOptions)
+
+type watchOptions struct {
+	debounce time.Duration
+	bias     Bias
+}
+
+// WithDebounce sets the line's debounce period. It is honored on the uAPI v2
+// path; it is a no-op when falling back to the older uAPI v1 ioctls, which
+// have no debounce support.
+func WithDebounce(d time.Duration) WatchOption {
+	return func(o *watchOptions) {
+		o.debounce = d
+	}
+}
+
+// WithBias configures the watched line's internal pull resistor.
+func WithBias(bias Bias) WatchOption {
+	return func(o *watchOptions) {
+		o.bias = bias
+	}
+}
+
+// eventChannelSize is the number of buffered Events kept between the reader
+// goroutine and the consumer.
+const eventChannelSize = 16
+
+// gpio_v2_line_* mirror the structures in linux/gpio.h (GPIO uAPI v2).
+const (
+	gpioV2LineFlagInput        uint64 = 1 << 2
+	gpioV2LineFlagEdgeRising   uint64 = 1 << 4
+	gpioV2LineFlagEdgeFalling  uint64 = 1 << 5
+	gpioV2LineFlagBiasPullUp   uint64 = 1 << 8
+	gpioV2LineFlagBiasPullDown uint64 = 1 << 9
+	gpioV2LineFlagBiasDisabled uint64 = 1 << 10
+)
+
+const gpioV2LineAttrIDDebounce uint32 = 3
+
+const (
+	gpioV2LineEventRisingEdge  uint32 = 1
+	gpioV2LineEventFallingEdge uint32 = 2
+)
+
+type gpioV2LineAttribute struct {
+	id      uint32
+	padding uint32
+	value   uint64
+}
+
+type gpioV2LineConfigAttribute struct {
+	attr gpioV2LineAttribute
+	mask uint64
+}
+
+type gpioV2LineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	padding  [5]uint32
+	attrs    [10]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	offsets         [64]uint32
+	consumer        [32]byte
+	config          gpioV2LineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	padding         [5]uint32
+	fd              int32
+}
+
+type gpioV2LineEvent struct {
+	timestampNs uint64
+	id          uint32
+	offset      uint32
+	seqno       uint32
+	lineSeqno   uint32
+	padding     [6]uint32
+}
+
+// gpiohandle_request/gpioevent_* mirror the structures in linux/gpio.h (GPIO uAPI v1).
+const (
+	gpioHandleRequestInput        uint32 = 1 << 0
+	gpioHandleRequestBiasPullUp   uint32 = 1 << 5
+	gpioHandleRequestBiasPullDown uint32 = 1 << 6
+)
+
+const (
+	gpioEventRequestRisingEdge  uint32 = 1 << 0
+	gpioEventRequestFallingEdge uint32 = 1 << 1
+)
+
+const (
+	gpioEventEventRisingEdge  uint32 = 0x01
+	gpioEventEventFallingEdge uint32 = 0x02
+)
+
+type gpioEventRequest struct {
+	lineOffset    uint32
+	handleFlags   uint32
+	eventFlags    uint32
+	consumerLabel [32]byte
+	fd            int32
+}
+
+type gpioEventData struct {
+	timestamp uint64
+	id        uint32
+}
+
+// iowr computes the _IOWR(type, nr, size) ioctl number used by the GPIO
+// character device, using the size of the actual request struct so the
+// encoded size always matches what's read off the wire.
+func iowr(typ, nr, size uintptr) uintptr {
+	const ioctlDirShift = 30
+	const ioctlSizeShift = 16
+	const ioctlTypeShift = 8
+	const ioctlReadWrite = 3
+	return (ioctlReadWrite << ioctlDirShift) | (size << ioctlSizeShift) | (typ << ioctlTypeShift) | nr
+}
+
+const gpioIoctlType = 0xB4
+
+var (
+	gpioV2GetLineIoctl    = iowr(gpioIoctlType, 0x07, unsafe.Sizeof(gpioV2LineRequest{}))
+	gpioEventRequestIoctl = iowr(gpioIoctlType, 0x04, unsafe.Sizeof(gpioEventRequest{}))
+)
+
+func edgeToV2Flags(edge Edge) uint64 {
+	var flags uint64
+	if edge == EdgeRising || edge == EdgeBoth {
+		flags |= gpioV2LineFlagEdgeRising
+	}
+	if edge == EdgeFalling || edge == EdgeBoth {
+		flags |= gpioV2LineFlagEdgeFalling
+	}
+	return flags
+}
+
+func biasToV2Flags(bias Bias) uint64 {
+	switch bias {
+	case BiasPullUp:
+		return gpioV2LineFlagBiasPullUp
+	case BiasPullDown:
+		return gpioV2LineFlagBiasPullDown
+	default:
+		return 0
+	}
+}
+
+func edgeToV1Flags(edge Edge) uint32 {
+	var flags uint32
+	if edge == EdgeRising || edge == EdgeBoth {
+		flags |= gpioEventRequestRisingEdge
+	}
+	if edge == EdgeFalling || edge == EdgeBoth {
+		flags |= gpioEventRequestFallingEdge
+	}
+	return flags
+}
+
+func biasToV1Flags(bias Bias) uint32 {
+	switch bias {
+	case BiasPullUp:
+		return gpioHandleRequestBiasPullUp
+	case BiasPullDown:
+		return gpioHandleRequestBiasPullDown
+	default:
+		return 0
+	}
+}
+
+// watchEdgeV2 requests edge events for offset on the gpiochip at chipPath
+// using the modern (uAPI v2) GPIO_V2_GET_LINE_IOCTL.
+func watchEdgeV2(chipPath string, offset uint32, edge Edge, options *watchOptions) (<-chan Event, int, error) {
+	chipFd, err := unix.Open(chipPath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer unix.Close(chipFd)
+	req := gpioV2LineRequest{numLines: 1}
+	req.offsets[0] = offset
+	copy(req.consumer[:], "go-pi")
+	req.config.flags = gpioV2LineFlagInput | edgeToV2Flags(edge) | biasToV2Flags(options.bias)
+	if options.debounce > 0 {
+		req.config.numAttrs = 1
+		req.config.attrs[0] = gpioV2LineConfigAttribute{
+			attr: gpioV2LineAttribute{id: gpioV2LineAttrIDDebounce, value: uint64(options.debounce / time.Microsecond)},
+			mask: 1,
+		}
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(chipFd), gpioV2GetLineIoctl, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return nil, -1, errno
+	}
+	lineFd := int(req.fd)
+	events := make(chan Event, eventChannelSize)
+	go func() {
+		defer close(events)
+		buf := make([]byte, unsafe.Sizeof(gpioV2LineEvent{}))
+		for {
+			n, err := unix.Read(lineFd, buf)
+			if err != nil || n != len(buf) {
+				return
+			}
+			ev := gpioV2LineEvent{
+				timestampNs: binary.LittleEndian.Uint64(buf[0:8]),
+				id:          binary.LittleEndian.Uint32(buf[8:12]),
+				offset:      binary.LittleEndian.Uint32(buf[12:16]),
+				seqno:       binary.LittleEndian.Uint32(buf[16:20]),
+				lineSeqno:   binary.LittleEndian.Uint32(buf[20:24]),
+			}
+			e := Event{Timestamp: time.Duration(ev.timestampNs), Seqno: ev.seqno}
+			if ev.id == gpioV2LineEventRisingEdge {
+				e.Edge = EdgeRising
+			} else {
+				e.Edge = EdgeFalling
+			}
+			events <- e
+		}
+	}()
+	return events, lineFd, nil
+}
+
+// watchEdgeV1 requests edge events for offset on the gpiochip at chipPath
+// using the legacy (uAPI v1) GPIOEVENT_REQUEST_IOCTL, for kernels too old to
+// support GPIO_V2_GET_LINE_IOCTL.
+func watchEdgeV1(chipPath string, offset uint32, edge Edge, options *watchOptions) (<-chan Event, int, error) {
+	chipFd, err := unix.Open(chipPath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer unix.Close(chipFd)
+	req := gpioEventRequest{
+		lineOffset:  offset,
+		handleFlags: gpioHandleRequestInput | biasToV1Flags(options.bias),
+		eventFlags:  edgeToV1Flags(edge),
+	}
+	copy(req.consumerLabel[:], "go-pi")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(chipFd), gpioEventRequestIoctl, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return nil, -1, errno
+	}
+	lineFd := int(req.fd)
+	events := make(chan Event, eventChannelSize)
+	go func() {
+		defer close(events)
+		buf := make([]byte, unsafe.Sizeof(gpioEventData{}))
+		for {
+			n, err := unix.Read(lineFd, buf)
+			if err != nil || n != len(buf) {
+				return
+			}
+			data := gpioEventData{
+				timestamp: binary.LittleEndian.Uint64(buf[0:8]),
+				id:        binary.LittleEndian.Uint32(buf[8:12]),
+			}
+			e := Event{Timestamp: time.Duration(data.timestamp)}
+			if data.id == gpioEventEventRisingEdge {
+				e.Edge = EdgeRising
+			} else {
+				e.Edge = EdgeFalling
+			}
+			events <- e
+		}
+	}()
+	return events, lineFd, nil
+}
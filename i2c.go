@@ -21,8 +21,10 @@
 package pi
 
 import (
+	"errors"
 	"io"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -46,6 +48,100 @@ const (
 	I2CPEC
 )
 
+// I2CSMBus is the ioctl number for SMBus-level (I2C_SMBUS) transfers.
+const I2CSMBus uint32 = 0x00000720
+
+// I2CFunc is a bitmask of the functionality an I2C adapter supports, as
+// reported by the I2CFuncs ioctl.
+type I2CFunc uint32
+
+const (
+	// I2CFuncI2C indicates the adapter supports plain I2C (and combined I2CRdWr) transfers.
+	I2CFuncI2C I2CFunc = 0x00000001
+	// I2CFunc10BitAddr indicates the adapter supports ten-bit addresses.
+	I2CFunc10BitAddr I2CFunc = 0x00000002
+	// I2CFuncSMBusReadByte indicates support for the SMBus "receive byte" transaction.
+	I2CFuncSMBusReadByte I2CFunc = 0x00020000
+	// I2CFuncSMBusWriteByte indicates support for the SMBus "send byte" transaction.
+	I2CFuncSMBusWriteByte I2CFunc = 0x00040000
+	// I2CFuncSMBusReadByteData indicates support for the SMBus "read byte" transaction.
+	I2CFuncSMBusReadByteData I2CFunc = 0x00080000
+	// I2CFuncSMBusWriteByteData indicates support for the SMBus "write byte" transaction.
+	I2CFuncSMBusWriteByteData I2CFunc = 0x00100000
+	// I2CFuncSMBusReadWordData indicates support for the SMBus "read word" transaction.
+	I2CFuncSMBusReadWordData I2CFunc = 0x00200000
+	// I2CFuncSMBusWriteWordData indicates support for the SMBus "write word" transaction.
+	I2CFuncSMBusWriteWordData I2CFunc = 0x00400000
+	// I2CFuncSMBusProcCall indicates support for the SMBus "process call" transaction.
+	I2CFuncSMBusProcCall I2CFunc = 0x00800000
+	// I2CFuncSMBusReadBlockData indicates support for the SMBus "block read" transaction.
+	I2CFuncSMBusReadBlockData I2CFunc = 0x01000000
+	// I2CFuncSMBusWriteBlockData indicates support for the SMBus "block write" transaction.
+	I2CFuncSMBusWriteBlockData I2CFunc = 0x02000000
+)
+
+// ErrUnsupported is returned when a requested transaction is not in the
+// adapter's I2CFunc functionality mask.
+var ErrUnsupported = errors.New("i2c: operation not supported by adapter")
+
+const (
+	// I2CMRD marks an I2CMessage as a read (otherwise it's a write).
+	I2CMRD uint16 = 0x0001
+	// I2CMTenBit marks an I2CMessage's Addr as a ten-bit address.
+	I2CMTenBit uint16 = 0x0010
+)
+
+// I2CMessage is a single message within a combined I2CRdWr transaction (mirrors struct i2c_msg).
+type I2CMessage struct {
+	// Addr is the slave address this message is directed at.
+	Addr uint16
+	// Flags is a combination of I2CMRD and I2CMTenBit.
+	Flags uint16
+	// Buf holds the data to write, or the buffer to read into.
+	Buf []byte
+}
+
+// i2cMsg mirrors the kernel's struct i2c_msg.
+type i2cMsg struct {
+	addr  uint16
+	flags uint16
+	len   uint16
+	buf   *byte
+}
+
+// i2cRdwrIoctlData mirrors the kernel's struct i2c_rdwr_ioctl_data.
+type i2cRdwrIoctlData struct {
+	msgs  *i2cMsg
+	nmsgs uint32
+}
+
+const (
+	i2cSMBusWrite uint8 = 0
+	i2cSMBusRead  uint8 = 1
+)
+
+const (
+	i2cSMBusByte      uint32 = 1
+	i2cSMBusByteData  uint32 = 2
+	i2cSMBusWordData  uint32 = 3
+	i2cSMBusProcCall  uint32 = 4
+	i2cSMBusBlockData uint32 = 5
+)
+
+// i2cSMBusData mirrors the kernel's union i2c_smbus_data: a byte, a word, or a
+// block with a leading length byte followed by up to 32 data bytes.
+type i2cSMBusData struct {
+	data [34]byte
+}
+
+// i2cSMBusIoctlData mirrors the kernel's struct i2c_smbus_ioctl_data.
+type i2cSMBusIoctlData struct {
+	readWrite uint8
+	command   uint8
+	size      uint32
+	data      *i2cSMBusData
+}
+
 // I2CBus defines the behavior of an I2C bus).
 type I2CBus interface {
 	io.Reader
@@ -53,10 +149,36 @@ type I2CBus interface {
 	io.Closer
 	// SetSlave addresses a specific slave.
 	SetSlave(address uint8) error
+	// ReadReg writes reg as a register address, then reads len(p) bytes from
+	// it using a single combined (repeated-START) transaction.
+	ReadReg(reg byte, p []byte) (int, error)
+	// WriteReg writes p to the register at address reg.
+	WriteReg(reg byte, p []byte) (int, error)
+	// Transact performs a single I2CRdWr transaction carrying one or more combined messages.
+	Transact(msgs []I2CMessage) error
+	// Funcs returns the adapter's I2CFunc functionality mask.
+	Funcs() (I2CFunc, error)
+	// ReadByte performs an SMBus "receive byte" transaction.
+	ReadByte() (byte, error)
+	// WriteByte performs an SMBus "send byte" transaction.
+	WriteByte(value byte) error
+	// ReadWord performs an SMBus "read word data" transaction.
+	ReadWord(reg byte) (uint16, error)
+	// WriteWord performs an SMBus "write word data" transaction.
+	WriteWord(reg byte, value uint16) error
+	// ReadBlock performs an SMBus "block read" transaction.
+	ReadBlock(reg byte) ([]byte, error)
+	// ProcessCall performs an SMBus "process call" transaction.
+	ProcessCall(reg byte, value uint16) (uint16, error)
+	// SetTenBit enables or disables ten-bit slave addressing.
+	SetTenBit(enabled bool) error
+	// SetPEC enables or disables SMBus packet error checking.
+	SetPEC(enabled bool) error
 }
 
 type i2cBus struct {
-	fd int
+	fd      int
+	address uint8
 }
 
 // OpenI2CBus opens the I2C bus at the specified path.
@@ -110,5 +232,198 @@ func (i *i2cBus) SetSlave(address uint8) error {
 	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i.fd), uintptr(I2CSlave), uintptr(address)); err != 0 {
 		return err
 	}
+	i.address = address
+	return nil
+}
+
+func (i *i2cBus) ReadReg(reg byte, p []byte) (int, error) {
+	if i.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	regBuf := []byte{reg}
+	msgs := []I2CMessage{
+		{Addr: uint16(i.address), Buf: regBuf},
+		{Addr: uint16(i.address), Flags: I2CMRD, Buf: p},
+	}
+	if err := i.Transact(msgs); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (i *i2cBus) WriteReg(reg byte, p []byte) (int, error) {
+	if i.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	buf := make([]byte, len(p)+1)
+	buf[0] = reg
+	copy(buf[1:], p)
+	n, err := i.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	return n - 1, nil
+}
+
+func (i *i2cBus) Transact(msgs []I2CMessage) error {
+	if i.fd == -1 {
+		return syscall.EINVAL
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	kmsgs := make([]i2cMsg, len(msgs))
+	for n, msg := range msgs {
+		kmsgs[n] = i2cMsg{addr: msg.Addr, flags: msg.Flags, len: uint16(len(msg.Buf))}
+		if len(msg.Buf) > 0 {
+			kmsgs[n].buf = &msg.Buf[0]
+		}
+	}
+	data := i2cRdwrIoctlData{msgs: &kmsgs[0], nmsgs: uint32(len(kmsgs))}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i.fd), uintptr(I2CRdWr), uintptr(unsafe.Pointer(&data))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (i *i2cBus) Funcs() (I2CFunc, error) {
+	if i.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	var funcs uint32
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i.fd), uintptr(I2CFuncs), uintptr(unsafe.Pointer(&funcs))); err != 0 {
+		return 0, err
+	}
+	return I2CFunc(funcs), nil
+}
+
+func (i *i2cBus) requireFunc(f I2CFunc) error {
+	funcs, err := i.Funcs()
+	if err != nil {
+		return err
+	}
+	if funcs&f == 0 {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+func (i *i2cBus) smbusIoctl(readWrite uint8, command byte, size uint32, data *i2cSMBusData) error {
+	req := i2cSMBusIoctlData{readWrite: readWrite, command: command, size: size, data: data}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i.fd), uintptr(I2CSMBus), uintptr(unsafe.Pointer(&req))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (i *i2cBus) ReadByte() (byte, error) {
+	if i.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	if err := i.requireFunc(I2CFuncSMBusReadByte); err != nil {
+		return 0, err
+	}
+	var data i2cSMBusData
+	if err := i.smbusIoctl(i2cSMBusRead, 0, i2cSMBusByte, &data); err != nil {
+		return 0, err
+	}
+	return data.data[0], nil
+}
+
+func (i *i2cBus) WriteByte(value byte) error {
+	if i.fd == -1 {
+		return syscall.EINVAL
+	}
+	if err := i.requireFunc(I2CFuncSMBusWriteByte); err != nil {
+		return err
+	}
+	return i.smbusIoctl(i2cSMBusWrite, value, i2cSMBusByte, nil)
+}
+
+func (i *i2cBus) ReadWord(reg byte) (uint16, error) {
+	if i.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	if err := i.requireFunc(I2CFuncSMBusReadWordData); err != nil {
+		return 0, err
+	}
+	var data i2cSMBusData
+	if err := i.smbusIoctl(i2cSMBusRead, reg, i2cSMBusWordData, &data); err != nil {
+		return 0, err
+	}
+	return uint16(data.data[0]) | uint16(data.data[1])<<8, nil
+}
+
+func (i *i2cBus) WriteWord(reg byte, value uint16) error {
+	if i.fd == -1 {
+		return syscall.EINVAL
+	}
+	if err := i.requireFunc(I2CFuncSMBusWriteWordData); err != nil {
+		return err
+	}
+	data := i2cSMBusData{}
+	data.data[0] = byte(value)
+	data.data[1] = byte(value >> 8)
+	return i.smbusIoctl(i2cSMBusWrite, reg, i2cSMBusWordData, &data)
+}
+
+func (i *i2cBus) ReadBlock(reg byte) ([]byte, error) {
+	if i.fd == -1 {
+		return nil, syscall.EINVAL
+	}
+	if err := i.requireFunc(I2CFuncSMBusReadBlockData); err != nil {
+		return nil, err
+	}
+	var data i2cSMBusData
+	if err := i.smbusIoctl(i2cSMBusRead, reg, i2cSMBusBlockData, &data); err != nil {
+		return nil, err
+	}
+	count := int(data.data[0])
+	block := make([]byte, count)
+	copy(block, data.data[1:1+count])
+	return block, nil
+}
+
+func (i *i2cBus) ProcessCall(reg byte, value uint16) (uint16, error) {
+	if i.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	if err := i.requireFunc(I2CFuncSMBusProcCall); err != nil {
+		return 0, err
+	}
+	data := i2cSMBusData{}
+	data.data[0] = byte(value)
+	data.data[1] = byte(value >> 8)
+	if err := i.smbusIoctl(i2cSMBusWrite, reg, i2cSMBusProcCall, &data); err != nil {
+		return 0, err
+	}
+	return uint16(data.data[0]) | uint16(data.data[1])<<8, nil
+}
+
+func (i *i2cBus) SetTenBit(enabled bool) error {
+	if i.fd == -1 {
+		return syscall.EINVAL
+	}
+	var value uintptr
+	if enabled {
+		value = 1
+	}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i.fd), uintptr(I2CTenBit), value); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (i *i2cBus) SetPEC(enabled bool) error {
+	if i.fd == -1 {
+		return syscall.EINVAL
+	}
+	var value uintptr
+	if enabled {
+		value = 1
+	}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i.fd), uintptr(I2CPEC), value); err != 0 {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,373 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pi
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// PWM represents a single PWM output, whether software- or hardware-driven.
+type PWM interface {
+	io.Closer
+	// SetDutyCycle sets the duty cycle as a fraction in [0.0, 1.0].
+	SetDutyCycle(duty float64) error
+	// SetFrequency sets the output frequency in Hz.
+	SetFrequency(freqHz float64) error
+}
+
+// softSpinThreshold is the portion of each half-period that is busy-waited
+// rather than slept, to make up for the scheduler's wakeup jitter.
+const softSpinThreshold = time.Millisecond
+
+type softPWM struct {
+	data      []byte
+	registers []uint32
+	id        uint32
+	freqBits  uint64
+	dutyBits  uint64
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// SoftPWM returns a PWM that drives pin by toggling it from a dedicated,
+// OS-thread-locked goroutine rather than using a hardware PWM channel. It
+// works on any output-capable pin, at the cost of CPU time and some jitter.
+func SoftPWM(pin Pin, freqHz float64) (PWM, error) {
+	b, err := DetectBoard()
+	if err != nil {
+		return nil, err
+	}
+	return newSoftPWM(b, pin, freqHz)
+}
+
+func newSoftPWM(b Board, pin Pin, freqHz float64) (PWM, error) {
+	if freqHz <= 0 {
+		return nil, fmt.Errorf("pi: frequency must be positive")
+	}
+	desc, ok := b.PinMap().ByNumber(uint8(pin))
+	if !ok {
+		return nil, fmt.Errorf("pi: %s has no pin %d", b.Name(), pin)
+	}
+	if desc.Capabilities&CapOutput == 0 {
+		return nil, fmt.Errorf("pi: pin %d on %s does not support output", pin, b.Name())
+	}
+	fd, err := unix.Open("/dev/gpiomem", unix.O_RDWR|unix.O_SYNC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	data, err := unix.Mmap(fd, b.BaseAddress()+GpioOffset, PageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	registers := *(*[]uint32)(unsafe.Pointer(&data))
+	offset := pin / 10
+	count := (pin % 10) * 3
+	registers[offset] &^= (7 << count)
+	registers[offset] |= (1 << count)
+	p := &softPWM{
+		data:      data,
+		registers: registers,
+		id:        uint32(1 << pin),
+		freqBits:  math.Float64bits(freqHz),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *softPWM) run() {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		period := time.Duration(float64(time.Second) / p.frequency())
+		onTime := time.Duration(p.dutyCycle() * float64(period))
+		offTime := period - onTime
+		if onTime > 0 {
+			p.registers[GpSet0] = p.id
+			sleepPrecise(onTime)
+		}
+		if offTime > 0 {
+			p.registers[GpClr0] = p.id
+			sleepPrecise(offTime)
+		}
+	}
+}
+
+// sleepPrecise sleeps for d, busy-waiting the last softSpinThreshold of it so
+// that sub-millisecond edge timing isn't lost to scheduler wakeup jitter.
+func sleepPrecise(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	start := time.Now()
+	if d > softSpinThreshold {
+		time.Sleep(d - softSpinThreshold)
+	}
+	for time.Since(start) < d {
+	}
+}
+
+func (p *softPWM) frequency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&p.freqBits))
+}
+
+func (p *softPWM) dutyCycle() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&p.dutyBits))
+}
+
+func (p *softPWM) SetDutyCycle(duty float64) error {
+	if duty < 0.0 || duty > 1.0 {
+		return fmt.Errorf("pi: duty cycle %f out of range [0.0, 1.0]", duty)
+	}
+	atomic.StoreUint64(&p.dutyBits, math.Float64bits(duty))
+	return nil
+}
+
+func (p *softPWM) SetFrequency(freqHz float64) error {
+	if freqHz <= 0 {
+		return fmt.Errorf("pi: frequency must be positive")
+	}
+	atomic.StoreUint64(&p.freqBits, math.Float64bits(freqHz))
+	return nil
+}
+
+func (p *softPWM) Close() error {
+	if p.data == nil {
+		return syscall.EINVAL
+	}
+	close(p.done)
+	<-p.stopped
+	if err := unix.Munmap(p.data); err != nil {
+		return err
+	}
+	p.data = nil
+	p.registers = nil
+	return nil
+}
+
+// PwmBase is the offset of the BCM2835 PWM peripheral into the SoC register space.
+const PwmBase int64 = 0x20c000
+
+// CmBase is the offset of the BCM2835 clock manager into the SoC register space.
+const CmBase int64 = 0x101000
+
+// cmPasswd is the password required in the top byte of any CM_* register write.
+const cmPasswd uint32 = 0x5a000000
+
+// cmPwmCtlReg and cmPwmDivReg are the CM_PWMCTL/CM_PWMDIV register indices
+// (4-byte words) within the page mapped at CmBase.
+const (
+	cmPwmCtlReg = 0xa0 / 4
+	cmPwmDivReg = 0xa4 / 4
+)
+
+const (
+	cmSrcOscillator = 1
+	cmEnab          = 1 << 4
+	cmBusy          = 1 << 7
+)
+
+// pwmCtlReg, pwmRng1Reg, pwmDat1Reg, pwmRng2Reg and pwmDat2Reg are PWM_*
+// register indices (4-byte words) within the page mapped at PwmBase.
+const (
+	pwmCtlReg  = 0x00 / 4
+	pwmRng1Reg = 0x10 / 4
+	pwmDat1Reg = 0x14 / 4
+	pwmRng2Reg = 0x20 / 4
+	pwmDat2Reg = 0x24 / 4
+)
+
+// pwmClockHz is the frequency of the oscillator that feeds PWMCLK.
+const pwmClockHz float64 = 19.2e6
+
+// hardwarePWMPins maps each PWM channel to the GPIO pin that carries it via ALT0.
+var hardwarePWMPins = map[int]Pin{0: 12, 1: 13}
+
+type hardwarePWM struct {
+	channel       int
+	gpioData      []byte
+	cmData        []byte
+	pwmData       []byte
+	gpioRegisters []uint32
+	cmRegisters   []uint32
+	pwmRegisters  []uint32
+	rng           uint32
+}
+
+// HardwarePWM returns a PWM backed by the BCM2835 PWM peripheral on the given
+// channel (0 or 1), switching the channel's GPIO pin (12 or 13) into its ALT0
+// PWM function.
+func HardwarePWM(channel int, freqHz float64) (PWM, error) {
+	b, err := DetectBoard()
+	if err != nil {
+		return nil, err
+	}
+	return newHardwarePWM(b, channel, freqHz)
+}
+
+func newHardwarePWM(b Board, channel int, freqHz float64) (PWM, error) {
+	pin, ok := hardwarePWMPins[channel]
+	if !ok {
+		return nil, fmt.Errorf("pi: invalid PWM channel %d", channel)
+	}
+	if freqHz <= 0 {
+		return nil, fmt.Errorf("pi: frequency must be positive")
+	}
+	gpioFd, err := unix.Open("/dev/gpiomem", unix.O_RDWR|unix.O_SYNC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(gpioFd)
+	gpioData, err := unix.Mmap(gpioFd, b.BaseAddress()+GpioOffset, PageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	gpioRegisters := *(*[]uint32)(unsafe.Pointer(&gpioData))
+	offset := pin / 10
+	count := (pin % 10) * 3
+	gpioRegisters[offset] &^= (7 << count)
+	gpioRegisters[offset] |= (4 << count) // ALT0
+	memFd, err := unix.Open("/dev/mem", unix.O_RDWR|unix.O_SYNC, 0)
+	if err != nil {
+		unix.Munmap(gpioData)
+		return nil, err
+	}
+	defer unix.Close(memFd)
+	cmData, err := unix.Mmap(memFd, b.BaseAddress()+CmBase, PageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		unix.Munmap(gpioData)
+		return nil, err
+	}
+	pwmData, err := unix.Mmap(memFd, b.BaseAddress()+PwmBase, PageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		unix.Munmap(gpioData)
+		unix.Munmap(cmData)
+		return nil, err
+	}
+	p := &hardwarePWM{
+		channel:       channel,
+		gpioData:      gpioData,
+		cmData:        cmData,
+		pwmData:       pwmData,
+		gpioRegisters: gpioRegisters,
+		cmRegisters:   *(*[]uint32)(unsafe.Pointer(&cmData)),
+		pwmRegisters:  *(*[]uint32)(unsafe.Pointer(&pwmData)),
+	}
+	if err := p.SetFrequency(freqHz); err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.enable()
+	return p, nil
+}
+
+func (p *hardwarePWM) rngReg() int {
+	if p.channel == 0 {
+		return pwmRng1Reg
+	}
+	return pwmRng2Reg
+}
+
+func (p *hardwarePWM) datReg() int {
+	if p.channel == 0 {
+		return pwmDat1Reg
+	}
+	return pwmDat2Reg
+}
+
+func (p *hardwarePWM) enable() {
+	pwenShift := uint(p.channel * 8)
+	msenShift := pwenShift + 7
+	p.pwmRegisters[pwmCtlReg] |= (1 << pwenShift) | (1 << msenShift)
+}
+
+func (p *hardwarePWM) SetFrequency(freqHz float64) error {
+	if freqHz <= 0 {
+		return fmt.Errorf("pi: frequency must be positive")
+	}
+	// Disable the clock before reprogramming it, per the BCM2835 datasheet.
+	p.cmRegisters[cmPwmCtlReg] = cmPasswd | cmSrcOscillator
+	for p.cmRegisters[cmPwmCtlReg]&cmBusy != 0 {
+		time.Sleep(time.Microsecond)
+	}
+	const targetRange = 1024
+	divi := uint32(pwmClockHz / (freqHz * targetRange))
+	if divi < 1 {
+		divi = 1
+	}
+	if divi > 4095 {
+		divi = 4095
+	}
+	rng := uint32(pwmClockHz / float64(divi) / freqHz)
+	if rng < 2 {
+		rng = 2
+	}
+	p.cmRegisters[cmPwmDivReg] = cmPasswd | (divi << 12)
+	p.cmRegisters[cmPwmCtlReg] = cmPasswd | cmSrcOscillator | cmEnab
+	p.rng = rng
+	p.pwmRegisters[p.rngReg()] = rng
+	return nil
+}
+
+func (p *hardwarePWM) SetDutyCycle(duty float64) error {
+	if duty < 0.0 || duty > 1.0 {
+		return fmt.Errorf("pi: duty cycle %f out of range [0.0, 1.0]", duty)
+	}
+	p.pwmRegisters[p.datReg()] = uint32(duty * float64(p.rng))
+	return nil
+}
+
+func (p *hardwarePWM) Close() error {
+	if p.pwmData == nil {
+		return syscall.EINVAL
+	}
+	pwenShift := uint(p.channel * 8)
+	p.pwmRegisters[pwmCtlReg] &^= (1 << pwenShift)
+	unix.Munmap(p.gpioData)
+	unix.Munmap(p.cmData)
+	if err := unix.Munmap(p.pwmData); err != nil {
+		return err
+	}
+	p.gpioData = nil
+	p.cmData = nil
+	p.pwmData = nil
+	p.gpioRegisters = nil
+	p.cmRegisters = nil
+	p.pwmRegisters = nil
+	return nil
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pi
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SPIMode is the SPI clock polarity/phase mode (CPOL/CPHA).
+type SPIMode uint8
+
+const (
+	// SPIMode0 is CPOL=0, CPHA=0.
+	SPIMode0 SPIMode = iota
+	// SPIMode1 is CPOL=0, CPHA=1.
+	SPIMode1
+	// SPIMode2 is CPOL=1, CPHA=0.
+	SPIMode2
+	// SPIMode3 is CPOL=1, CPHA=1.
+	SPIMode3
+)
+
+const spiIocMagic uintptr = 0x6b
+
+const (
+	iocWrite uintptr = 1
+	iocRead  uintptr = 2
+)
+
+// ioc computes the _IOR/_IOW/_IOWR(type, nr, size) ioctl number used by spidev.
+func ioc(dir, typ, nr, size uintptr) uintptr {
+	const ioctlDirShift = 30
+	const ioctlSizeShift = 16
+	const ioctlTypeShift = 8
+	return (dir << ioctlDirShift) | (size << ioctlSizeShift) | (typ << ioctlTypeShift) | nr
+}
+
+var (
+	spiIocRdMode        = ioc(iocRead, spiIocMagic, 1, 1)
+	spiIocWrMode        = ioc(iocWrite, spiIocMagic, 1, 1)
+	spiIocRdLSBFirst    = ioc(iocRead, spiIocMagic, 2, 1)
+	spiIocWrLSBFirst    = ioc(iocWrite, spiIocMagic, 2, 1)
+	spiIocRdBitsPerWord = ioc(iocRead, spiIocMagic, 3, 1)
+	spiIocWrBitsPerWord = ioc(iocWrite, spiIocMagic, 3, 1)
+	spiIocRdMaxSpeedHz  = ioc(iocRead, spiIocMagic, 4, 4)
+	spiIocWrMaxSpeedHz  = ioc(iocWrite, spiIocMagic, 4, 4)
+)
+
+// spiIocMessage computes SPI_IOC_MESSAGE(n): a write ioctl carrying n spiIOCTransfer structs.
+func spiIocMessage(n uintptr) uintptr {
+	return ioc(iocWrite, spiIocMagic, 0, n*uintptr(unsafe.Sizeof(spiIOCTransfer{})))
+}
+
+// spiIOCTransfer mirrors the kernel's struct spi_ioc_transfer.
+type spiIOCTransfer struct {
+	txBuf       uint64
+	rxBuf       uint64
+	len         uint32
+	speedHz     uint32
+	delayUsecs  uint16
+	bitsPerWord uint8
+	csChange    uint8
+	txNbits     uint8
+	rxNbits     uint8
+	pad         uint16
+}
+
+// SPITransfer describes a single full-duplex transfer within a TransferMulti call.
+type SPITransfer struct {
+	// Tx is the data to write. May be nil for a read-only transfer.
+	Tx []byte
+	// Rx receives the data read back. May be nil for a write-only transfer.
+	Rx []byte
+	// SpeedHz overrides the bus's configured max speed for this transfer, if non-zero.
+	SpeedHz uint32
+	// DelayUsecs is the delay, in microseconds, to insert after this transfer.
+	DelayUsecs uint16
+	// BitsPerWord overrides the bus's configured word size for this transfer, if non-zero.
+	BitsPerWord uint8
+	// CSChange toggles chip-select after this transfer.
+	CSChange bool
+}
+
+// SPIBus defines the behavior of an SPI bus.
+type SPIBus interface {
+	io.Closer
+	// Transfer performs a single full-duplex transfer, writing tx and reading into rx.
+	Transfer(tx []byte, rx []byte) error
+	// TransferMulti performs a sequence of transfers as a single SPI_IOC_MESSAGE ioctl.
+	TransferMulti(xfers []SPITransfer) error
+	// SetMode sets the clock polarity/phase mode.
+	SetMode(mode SPIMode) error
+	// Mode returns the current clock polarity/phase mode.
+	Mode() (SPIMode, error)
+	// SetLSBFirst sets whether the least significant bit is transferred first.
+	SetLSBFirst(enabled bool) error
+	// LSBFirst returns whether the least significant bit is transferred first.
+	LSBFirst() (bool, error)
+	// SetBitsPerWord sets the word size used for transfers.
+	SetBitsPerWord(bits uint8) error
+	// BitsPerWord returns the configured word size.
+	BitsPerWord() (uint8, error)
+	// SetMaxSpeed sets the maximum clock speed, in Hz.
+	SetMaxSpeed(hz uint32) error
+	// MaxSpeed returns the configured maximum clock speed, in Hz.
+	MaxSpeed() (uint32, error)
+}
+
+type spiBus struct {
+	fd int
+}
+
+// OpenSPIBus opens the SPI bus at the specified path (e.g. "/dev/spidev0.0").
+func OpenSPIBus(path string) (SPIBus, error) {
+	fd, err := unix.Open(path, unix.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &spiBus{
+		fd: fd,
+	}, nil
+}
+
+func (s *spiBus) Close() error {
+	if s.fd == -1 {
+		return syscall.EINVAL
+	}
+	if err := unix.Close(s.fd); err != nil {
+		return err
+	}
+	s.fd = -1
+	return nil
+}
+
+func (s *spiBus) Transfer(tx []byte, rx []byte) error {
+	if len(tx) > 0 && len(rx) > 0 && len(tx) != len(rx) {
+		return errors.New("spi: tx and rx length mismatch")
+	}
+	return s.TransferMulti([]SPITransfer{{Tx: tx, Rx: rx}})
+}
+
+func (s *spiBus) TransferMulti(xfers []SPITransfer) error {
+	if s.fd == -1 {
+		return syscall.EINVAL
+	}
+	if len(xfers) == 0 {
+		return nil
+	}
+	transfers := make([]spiIOCTransfer, len(xfers))
+	for n, x := range xfers {
+		length := len(x.Tx)
+		if len(x.Rx) > length {
+			length = len(x.Rx)
+		}
+		transfers[n].len = uint32(length)
+		transfers[n].speedHz = x.SpeedHz
+		transfers[n].delayUsecs = x.DelayUsecs
+		transfers[n].bitsPerWord = x.BitsPerWord
+		if x.CSChange {
+			transfers[n].csChange = 1
+		}
+		if len(x.Tx) > 0 {
+			transfers[n].txBuf = uint64(uintptr(unsafe.Pointer(&x.Tx[0])))
+		}
+		if len(x.Rx) > 0 {
+			transfers[n].rxBuf = uint64(uintptr(unsafe.Pointer(&x.Rx[0])))
+		}
+	}
+	req := spiIocMessage(uintptr(len(transfers)))
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), req, uintptr(unsafe.Pointer(&transfers[0]))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (s *spiBus) SetMode(mode SPIMode) error {
+	if s.fd == -1 {
+		return syscall.EINVAL
+	}
+	var value uint8
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocRdMode, uintptr(unsafe.Pointer(&value))); err != 0 {
+		return err
+	}
+	// Only CPOL/CPHA (the low two bits) change; LSB-first and the other mode bits are kept.
+	value = (value &^ 0x03) | (uint8(mode) & 0x03)
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocWrMode, uintptr(unsafe.Pointer(&value))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (s *spiBus) Mode() (SPIMode, error) {
+	if s.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	var value uint8
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocRdMode, uintptr(unsafe.Pointer(&value))); err != 0 {
+		return 0, err
+	}
+	return SPIMode(value & 0x03), nil
+}
+
+func (s *spiBus) SetLSBFirst(enabled bool) error {
+	if s.fd == -1 {
+		return syscall.EINVAL
+	}
+	var value uint8
+	if enabled {
+		value = 1
+	}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocWrLSBFirst, uintptr(unsafe.Pointer(&value))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (s *spiBus) LSBFirst() (bool, error) {
+	if s.fd == -1 {
+		return false, syscall.EINVAL
+	}
+	var value uint8
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocRdLSBFirst, uintptr(unsafe.Pointer(&value))); err != 0 {
+		return false, err
+	}
+	return value != 0, nil
+}
+
+func (s *spiBus) SetBitsPerWord(bits uint8) error {
+	if s.fd == -1 {
+		return syscall.EINVAL
+	}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocWrBitsPerWord, uintptr(unsafe.Pointer(&bits))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (s *spiBus) BitsPerWord() (uint8, error) {
+	if s.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	var value uint8
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocRdBitsPerWord, uintptr(unsafe.Pointer(&value))); err != 0 {
+		return 0, err
+	}
+	return value, nil
+}
+
+func (s *spiBus) SetMaxSpeed(hz uint32) error {
+	if s.fd == -1 {
+		return syscall.EINVAL
+	}
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocWrMaxSpeedHz, uintptr(unsafe.Pointer(&hz))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func (s *spiBus) MaxSpeed() (uint32, error) {
+	if s.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	var value uint32
+	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(s.fd), spiIocRdMaxSpeedHz, uintptr(unsafe.Pointer(&value))); err != 0 {
+		return 0, err
+	}
+	return value, nil
+}
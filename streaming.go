@@ -0,0 +1,218 @@
+// Copyright (c) 2020 Peter Hagelund
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pi
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/peterhagelund/go-v4l2"
+)
+
+// v4l2CIDBase is V4L2_CID_BASE - the start of the standard user control ID space.
+const v4l2CIDBase uint32 = 0x00980900
+
+const (
+	// CtrlBrightness is V4L2_CID_BRIGHTNESS.
+	CtrlBrightness uint32 = v4l2CIDBase + 0
+	// CtrlContrast is V4L2_CID_CONTRAST.
+	CtrlContrast uint32 = v4l2CIDBase + 1
+	// CtrlSaturation is V4L2_CID_SATURATION.
+	CtrlSaturation uint32 = v4l2CIDBase + 2
+	// CtrlAutoWhiteBalance is V4L2_CID_AUTO_WHITE_BALANCE.
+	CtrlAutoWhiteBalance uint32 = v4l2CIDBase + 12
+	// CtrlExposure is V4L2_CID_EXPOSURE.
+	CtrlExposure uint32 = v4l2CIDBase + 17
+	// CtrlWhiteBalanceTemperature is V4L2_CID_WHITE_BALANCE_TEMPERATURE.
+	CtrlWhiteBalanceTemperature uint32 = v4l2CIDBase + 26
+)
+
+// DefaultStreamBufferCount is the number of MMAP buffers used by StartStream
+// when StreamConfig.BufferCount is zero.
+const DefaultStreamBufferCount uint32 = 4
+
+// v4l2PixFmtH264 is V4L2_PIX_FMT_H264, the four-character code 'H264'.
+const v4l2PixFmtH264 uint32 = 'H' | '2'<<8 | '6'<<16 | '4'<<24
+
+// supportsH264 reports whether the device has advertised V4L2_PIX_FMT_H264
+// among its capture formats.
+func (c *camera) supportsH264() bool {
+	for _, fmtDesc := range c.fmtDescs {
+		if uint32(fmtDesc.PixFormat) == v4l2PixFmtH264 {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamConfig configures a call to Camera.StartStream.
+type StreamConfig struct {
+	// Format is the format description as returned by Camera.Formats (e.g. "H.264", "YUYV 4:2:2").
+	Format string
+	// Width is the requested frame width.
+	Width uint32
+	// Height is the requested frame height.
+	Height uint32
+	// BufferCount is the number of MMAP buffers kept queued with the driver.
+	// If zero, DefaultStreamBufferCount is used.
+	BufferCount uint32
+}
+
+// Frame is a single frame delivered by Camera.StartStream. For a compressed
+// (e.g. V4L2_PIX_FMT_H264) stream, the driver fills one buffer with exactly
+// one access unit's worth of complete, start-code-delimited NAL units per
+// dequeue, so Data can be written straight to an RTSP/HLS muxer as-is.
+type Frame struct {
+	// Data is the raw frame bytes. The slice is owned by the caller; it is a
+	// copy of the driver's buffer and is safe to retain.
+	Data []byte
+	// Timestamp is the driver's capture timestamp for the buffer, as recorded
+	// by VIDIOC_DQBUF (struct v4l2_buffer.timestamp), not the time it was
+	// dequeued by this process.
+	Timestamp time.Time
+	// Sequence is the zero-based index of the MMAP buffer the frame came from.
+	Sequence uint32
+}
+
+func (c *camera) StartStream(ctx context.Context, config StreamConfig) (<-chan Frame, error) {
+	if c.fd == -1 {
+		return nil, syscall.EINVAL
+	}
+	if c.stopStream != nil {
+		return nil, errors.New("pi: stream already started")
+	}
+	pixFormat, err := c.mapFormat(config.Format)
+	if err != nil {
+		return nil, err
+	}
+	if uint32(pixFormat) == v4l2PixFmtH264 && !c.supportsH264() {
+		return nil, errors.New("pi: device does not advertise V4L2_PIX_FMT_H264")
+	}
+	if _, _, err := v4l2.SetFormat(c.fd, v4l2.BufTypeVideoCapture, pixFormat, config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	bufferCount := config.BufferCount
+	if bufferCount == 0 {
+		bufferCount = DefaultStreamBufferCount
+	}
+	count, err := v4l2.RequestDriverBuffers(c.fd, bufferCount, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap)
+	if err != nil {
+		return nil, err
+	}
+	buffers, err := v4l2.MmapBuffers(c.fd, count, v4l2.BufTypeVideoCapture)
+	if err != nil {
+		v4l2.RequestDriverBuffers(c.fd, 0, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap)
+		return nil, err
+	}
+	for index := uint32(0); index < count; index++ {
+		if err := v4l2.QueueBuffer(c.fd, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap, index); err != nil {
+			v4l2.MunmapBuffers(buffers)
+			v4l2.RequestDriverBuffers(c.fd, 0, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap)
+			return nil, err
+		}
+	}
+	if err := v4l2.StreamOn(c.fd, v4l2.BufTypeVideoCapture); err != nil {
+		v4l2.MunmapBuffers(buffers)
+		v4l2.RequestDriverBuffers(c.fd, 0, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap)
+		return nil, err
+	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	c.stopStream = cancel
+	done := make(chan struct{})
+	c.streamDone = done
+	frames := make(chan Frame, bufferCount)
+	go func() {
+		defer close(done)
+		c.streamLoop(streamCtx, buffers, frames)
+	}()
+	return frames, nil
+}
+
+func (c *camera) streamLoop(ctx context.Context, buffers []v4l2.Buffer, frames chan<- Frame) {
+	defer close(frames)
+	defer v4l2.RequestDriverBuffers(c.fd, 0, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap)
+	defer v4l2.MunmapBuffers(buffers)
+	defer v4l2.StreamOff(c.fd, v4l2.BufTypeVideoCapture)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		data, index, timestamp, err := v4l2.DequeueBuffer(c.fd, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap, buffers)
+		if err != nil {
+			return
+		}
+		frame := Frame{
+			Data:      append([]byte(nil), data...),
+			Timestamp: timestamp,
+			Sequence:  index,
+		}
+		select {
+		case frames <- frame:
+		case <-ctx.Done():
+			v4l2.QueueBuffer(c.fd, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap, index)
+			return
+		}
+		if err := v4l2.QueueBuffer(c.fd, v4l2.BufTypeVideoCapture, v4l2.MemoryMmap, index); err != nil {
+			return
+		}
+	}
+}
+
+// StopStream cancels the stream started with StartStream and blocks until
+// streamLoop has run its buffer-pool teardown, so it's safe to call
+// StartStream again immediately afterwards.
+func (c *camera) StopStream() error {
+	if c.stopStream == nil {
+		return syscall.EINVAL
+	}
+	cancel := c.stopStream
+	done := c.streamDone
+	c.stopStream = nil
+	c.streamDone = nil
+	cancel()
+	<-done
+	return nil
+}
+
+func (c *camera) SetControl(id uint32, value int32) error {
+	if c.fd == -1 {
+		return syscall.EINVAL
+	}
+	return v4l2.SetControl(c.fd, id, value)
+}
+
+func (c *camera) GetControl(id uint32) (int32, error) {
+	if c.fd == -1 {
+		return 0, syscall.EINVAL
+	}
+	return v4l2.GetControl(c.fd, id)
+}
+
+func (c *camera) SetFrameInterval(num uint32, den uint32) error {
+	if c.fd == -1 {
+		return syscall.EINVAL
+	}
+	return v4l2.SetFrameInterval(c.fd, v4l2.BufTypeVideoCapture, num, den)
+}